@@ -0,0 +1,101 @@
+// Package aggregate aggregates CIDR prefixes: overlapping and adjacent
+// prefixes are merged into the smallest equivalent set. The public API
+// works in terms of net/netip.Prefix; internally it builds one bit-trie per
+// address family (see trie.go), giving O(N*width) aggregation instead of
+// the quadratic sort-and-rescan a naive merge needs.
+package aggregate
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/netip"
+	"strings"
+)
+
+const (
+	width4 = 32
+	width6 = 128
+)
+
+// Aggregator accumulates prefixes of either address family and aggregates
+// them incrementally. The zero value is not usable; create one with
+// NewAggregator.
+type Aggregator struct {
+	v4 *trie
+	v6 *trie
+}
+
+// NewAggregator returns an empty Aggregator.
+func NewAggregator() *Aggregator {
+	return &Aggregator{v4: newTrie(width4), v6: newTrie(width6)}
+}
+
+// Add inserts p, in whichever address family it belongs to. Order doesn't
+// matter, see trie.insert.
+func (a *Aggregator) Add(p netip.Prefix) {
+	addr := p.Addr()
+	if addr.Is4() {
+		b := addr.As4()
+		a.v4.insert(b[:], p.Bits())
+		return
+	}
+	b := addr.As16()
+	a.v6.insert(b[:], p.Bits())
+}
+
+// Flush returns the aggregated result so far, v4 prefixes before v6.
+func (a *Aggregator) Flush() []netip.Prefix {
+	var out []netip.Prefix
+	for _, p := range a.v4.flush() {
+		out = append(out, netip.PrefixFrom(netip.AddrFrom4([4]byte(p.addr)), p.bits))
+	}
+	for _, p := range a.v6.flush() {
+		out = append(out, netip.PrefixFrom(netip.AddrFrom16([16]byte(p.addr)), p.bits))
+	}
+	return out
+}
+
+// Aggregate is a convenience wrapper for the common one-shot case: feed
+// every prefix through a fresh Aggregator and return the result.
+func Aggregate(prefixes []netip.Prefix) []netip.Prefix {
+	a := NewAggregator()
+	for _, p := range prefixes {
+		a.Add(p)
+	}
+	return a.Flush()
+}
+
+// AggregateReader reads one prefix per line from r - either a CIDR
+// ("10.0.0.0/24") or a bare address, treated as a single host (/32 or
+// /128) - and returns the aggregated result. Blank lines are skipped.
+func AggregateReader(r io.Reader) ([]netip.Prefix, error) {
+	a := NewAggregator()
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		p, err := parsePrefixOrAddr(line)
+		if err != nil {
+			return nil, err
+		}
+		a.Add(p)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return a.Flush(), nil
+}
+
+func parsePrefixOrAddr(s string) (netip.Prefix, error) {
+	if p, err := netip.ParsePrefix(s); err == nil {
+		return p, nil
+	}
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Prefix{}, fmt.Errorf("bad IP value: <%s>", s)
+	}
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
@@ -0,0 +1,110 @@
+package aggregate
+
+import (
+	"net/netip"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func mustPrefixes(t *testing.T, ss ...string) []netip.Prefix {
+	t.Helper()
+	out := make([]netip.Prefix, len(ss))
+	for i, s := range ss {
+		p, err := netip.ParsePrefix(s)
+		if err != nil {
+			t.Fatalf("ParsePrefix(%q): %v", s, err)
+		}
+		out[i] = p
+	}
+	return out
+}
+
+func TestAggregate(t *testing.T) {
+	cases := []struct {
+		name string
+		in   []string
+		want []string
+	}{
+		{
+			name: "sibling collapse",
+			in:   []string{"10.0.0.0/24", "10.0.1.0/24"},
+			want: []string{"10.0.0.0/23"},
+		},
+		{
+			name: "non-siblings stay separate",
+			in:   []string{"10.0.0.0/24", "10.0.2.0/24"},
+			want: []string{"10.0.0.0/24", "10.0.2.0/24"},
+		},
+		{
+			name: "absorption, subnet inserted first",
+			in:   []string{"10.0.0.0/24", "10.0.0.0/16"},
+			want: []string{"10.0.0.0/16"},
+		},
+		{
+			name: "absorption, supernet inserted first",
+			in:   []string{"10.0.0.0/16", "10.0.0.0/24"},
+			want: []string{"10.0.0.0/16"},
+		},
+		{
+			name: "duplicate entries collapse to one",
+			in:   []string{"10.0.0.0/24", "10.0.0.0/24"},
+			want: []string{"10.0.0.0/24"},
+		},
+		{
+			name: "cascading merge up multiple levels",
+			in:   []string{"10.0.0.0/24", "10.0.1.0/24", "10.0.2.0/24", "10.0.3.0/24"},
+			want: []string{"10.0.0.0/22"},
+		},
+		{
+			name: "ipv4 and ipv6 are bucketed independently",
+			in:   []string{"10.0.0.0/24", "10.0.1.0/24", "2001:db8::/33", "2001:db8:8000::/33"},
+			want: []string{"10.0.0.0/23", "2001:db8::/32"},
+		},
+		{
+			name: "insertion order does not affect the result",
+			in:   []string{"10.0.3.0/24", "10.0.0.0/24", "10.0.2.0/24", "10.0.1.0/24"},
+			want: []string{"10.0.0.0/22"},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			got := Aggregate(mustPrefixes(t, tc.in...))
+			want := mustPrefixes(t, tc.want...)
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("Aggregate(%v) = %v, want %v", tc.in, got, want)
+			}
+		})
+	}
+}
+
+func TestAggregator(t *testing.T) {
+	a := NewAggregator()
+	for _, p := range mustPrefixes(t, "10.0.0.0/24", "10.0.1.0/24") {
+		a.Add(p)
+	}
+	got := a.Flush()
+	want := mustPrefixes(t, "10.0.0.0/23")
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Flush() = %v, want %v", got, want)
+	}
+}
+
+func TestAggregateReader(t *testing.T) {
+	in := strings.NewReader("10.0.0.0/24\n10.0.1.0/24\n\n10.0.0.5\n2001:db8::1\n")
+	got, err := AggregateReader(in)
+	if err != nil {
+		t.Fatalf("AggregateReader: %v", err)
+	}
+	want := mustPrefixes(t, "10.0.0.0/23", "2001:db8::1/128")
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("AggregateReader() = %v, want %v", got, want)
+	}
+}
+
+func TestAggregateReaderBadLine(t *testing.T) {
+	if _, err := AggregateReader(strings.NewReader("not-an-ip\n")); err == nil {
+		t.Fatal("expected an error for a malformed line, got nil")
+	}
+}
@@ -0,0 +1,132 @@
+package aggregate
+
+import "net/netip"
+
+// StreamAggregator aggregates prefixes that arrive in non-decreasing
+// network-address order (ties broken with the enclosing, larger block
+// first) and emits completed prefixes as soon as nothing later in the
+// stream could still merge with them. This lets a caller aggregate a feed
+// too large to buffer, at the cost of only aggregating correctly when the
+// input already has that ordering.
+//
+// It keeps one pending stack per address family, the same cascading
+// absorb/merge rules as the trie, but bounded to the top of the stack: a
+// pending prefix is only emitted once the running input address has moved
+// past the last address its sibling could possibly occupy, so a chain of
+// merges (four /24s completing a /22, say) still has the chance to
+// collapse all the way up before any of it is flushed.
+type StreamAggregator struct {
+	pendingV4 []netip.Prefix
+	pendingV6 []netip.Prefix
+}
+
+// NewStreamAggregator returns an empty StreamAggregator.
+func NewStreamAggregator() *StreamAggregator {
+	return &StreamAggregator{}
+}
+
+// Add folds in the next prefix and returns whichever previously-pending
+// prefixes are now final.
+func (s *StreamAggregator) Add(p netip.Prefix) []netip.Prefix {
+	pending := &s.pendingV4
+	if p.Addr().Is6() {
+		pending = &s.pendingV6
+	}
+	*pending = merge(*pending, p)
+	return finalize(pending, p.Addr())
+}
+
+// Flush returns whatever candidates remain once the input is exhausted, v4
+// before v6.
+func (s *StreamAggregator) Flush() []netip.Prefix {
+	out := append([]netip.Prefix(nil), s.pendingV4...)
+	out = append(out, s.pendingV6...)
+	s.pendingV4 = nil
+	s.pendingV6 = nil
+	return out
+}
+
+// merge folds p into the pending stack. With ordered input the stack holds
+// disjoint prefixes in ascending address order, so only the top can be p's
+// sibling: merging the top with p can only make p bigger (fewer bits), so it
+// keeps cascading down into whatever was already pending, same as carries in
+// binary addition. Prefix lengths on the stack need not be monotonic.
+func merge(pending []netip.Prefix, p netip.Prefix) []netip.Prefix {
+	for len(pending) > 0 {
+		top := pending[len(pending)-1]
+
+		if p.Bits() <= top.Bits() && p.Contains(top.Addr()) {
+			// p encloses (or duplicates) top; top is absorbed, and p may
+			// still enclose whatever is below it too.
+			pending = pending[:len(pending)-1]
+			continue
+		}
+		if top.Contains(p.Addr()) {
+			// top already encloses p; p adds nothing.
+			return pending
+		}
+		if merged, ok := mergeSiblings(top, p); ok {
+			pending = pending[:len(pending)-1]
+			p = merged
+			continue
+		}
+		break
+	}
+	return append(pending, p)
+}
+
+// finalize pops and returns pending entries from the bottom for as long as
+// max has already passed their sibling boundary - meaning the other half
+// needed to grow them further can never arrive now. It stops at the first
+// entry whose boundary has not been passed, even if entries above it have
+// passed theirs, so output stays in address order. The top of the stack is never
+// finalized here since it's still the active candidate for future merges.
+func finalize(pending *[]netip.Prefix, max netip.Addr) []netip.Prefix {
+	var done []netip.Prefix
+	for len(*pending) > 1 {
+		entry := (*pending)[0]
+		if entry.Bits() == 0 || broadcastOf(supernet(entry)).Compare(max) >= 0 {
+			break
+		}
+		done = append(done, entry)
+		*pending = (*pending)[1:]
+	}
+	return done
+}
+
+// mergeSiblings reports whether a and b are the two halves of the same
+// supernet - same prefix length, and their one-bit-shorter supernets are
+// equal - in which case that supernet is their merge.
+func mergeSiblings(a, b netip.Prefix) (netip.Prefix, bool) {
+	if a.Bits() != b.Bits() || a.Bits() == 0 {
+		return netip.Prefix{}, false
+	}
+	sa := supernet(a)
+	sb := supernet(b)
+	if sa == sb {
+		return sa, true
+	}
+	return netip.Prefix{}, false
+}
+
+// supernet returns the one-bit-larger prefix containing p. Callers must not
+// pass a /0.
+func supernet(p netip.Prefix) netip.Prefix {
+	return netip.PrefixFrom(p.Addr(), p.Bits()-1).Masked()
+}
+
+// broadcastOf returns the last address covered by p.
+func broadcastOf(p netip.Prefix) netip.Addr {
+	width := 32
+	if p.Addr().Is6() {
+		width = 128
+	}
+	b := append([]byte(nil), p.Addr().AsSlice()...)
+	for i := p.Bits(); i < width; i++ {
+		setBit(b, i, 1)
+	}
+	if width == 32 {
+		return netip.AddrFrom4([4]byte(b))
+	}
+	return netip.AddrFrom16([16]byte(b))
+}
@@ -0,0 +1,95 @@
+package aggregate
+
+import (
+	"net/netip"
+	"reflect"
+	"testing"
+)
+
+func mustPrefix(t *testing.T, s string) netip.Prefix {
+	t.Helper()
+	p, err := netip.ParsePrefix(s)
+	if err != nil {
+		t.Fatalf("ParsePrefix(%q): %v", s, err)
+	}
+	return p
+}
+
+func TestStreamAggregatorInOrderMerge(t *testing.T) {
+	sa := NewStreamAggregator()
+	in := []string{"10.0.0.0/24", "10.0.1.0/24", "10.0.2.0/24", "10.0.3.0/24", "10.1.0.0/24"}
+
+	var emitted []netip.Prefix
+	for _, s := range in {
+		emitted = append(emitted, sa.Add(mustPrefix(t, s))...)
+	}
+	emitted = append(emitted, sa.Flush()...)
+
+	want := []netip.Prefix{mustPrefix(t, "10.0.0.0/22"), mustPrefix(t, "10.1.0.0/24")}
+	if !reflect.DeepEqual(emitted, want) {
+		t.Errorf("got %v, want %v", emitted, want)
+	}
+}
+
+func TestStreamAggregatorNonSiblingsStaySeparate(t *testing.T) {
+	sa := NewStreamAggregator()
+	var emitted []netip.Prefix
+	emitted = append(emitted, sa.Add(mustPrefix(t, "10.0.0.0/24"))...)
+	emitted = append(emitted, sa.Add(mustPrefix(t, "10.0.2.0/24"))...)
+	emitted = append(emitted, sa.Flush()...)
+
+	want := []netip.Prefix{mustPrefix(t, "10.0.0.0/24"), mustPrefix(t, "10.0.2.0/24")}
+	if !reflect.DeepEqual(emitted, want) {
+		t.Errorf("got %v, want %v", emitted, want)
+	}
+}
+
+// TestStreamAggregatorOutOfOrderEnclosingPrefix is a regression test for
+// 64334c1: a larger block arriving after one of its own subnets must absorb
+// it instead of being dropped as "already covered".
+func TestStreamAggregatorOutOfOrderEnclosingPrefix(t *testing.T) {
+	sa := NewStreamAggregator()
+	var emitted []netip.Prefix
+	emitted = append(emitted, sa.Add(mustPrefix(t, "10.0.0.0/24"))...)
+	emitted = append(emitted, sa.Add(mustPrefix(t, "10.0.0.0/16"))...)
+	emitted = append(emitted, sa.Flush()...)
+
+	want := []netip.Prefix{mustPrefix(t, "10.0.0.0/16")}
+	if !reflect.DeepEqual(emitted, want) {
+		t.Errorf("got %v, want %v", emitted, want)
+	}
+}
+
+// TestStreamAggregatorFinalizeBoundary checks that a pending prefix is held
+// back for as long as input stays within its sibling's address range - even
+// across an intervening prefix that doesn't merge with it directly - and is
+// only finalized once input genuinely moves past that range.
+func TestStreamAggregatorFinalizeBoundary(t *testing.T) {
+	sa := NewStreamAggregator()
+
+	if done := sa.Add(mustPrefix(t, "10.0.0.0/24")); len(done) != 0 {
+		t.Fatalf("after 10.0.0.0/24: got %v, want nothing finalized yet", done)
+	}
+	if done := sa.Add(mustPrefix(t, "10.0.1.0/24")); len(done) != 0 {
+		t.Fatalf("after merging to 10.0.0.0/23: got %v, want nothing finalized yet", done)
+	}
+
+	// 10.0.2.0/24 doesn't merge with the pending /23 directly, but it's
+	// still within the /23's sibling range (10.0.0.0/22 runs through
+	// 10.0.3.255), so the /23 must still be held back rather than flushed.
+	if done := sa.Add(mustPrefix(t, "10.0.2.0/24")); len(done) != 0 {
+		t.Fatalf("10.0.2.0/24 still inside sibling range: got %v, want nothing finalized yet", done)
+	}
+
+	// 10.1.0.0/24 is past that range, so both the /23 and the /24 behind it
+	// are now final.
+	done := sa.Add(mustPrefix(t, "10.1.0.0/24"))
+	want := []netip.Prefix{mustPrefix(t, "10.0.0.0/23"), mustPrefix(t, "10.0.2.0/24")}
+	if !reflect.DeepEqual(done, want) {
+		t.Errorf("got %v, want %v", done, want)
+	}
+
+	if rest := sa.Flush(); !reflect.DeepEqual(rest, []netip.Prefix{mustPrefix(t, "10.1.0.0/24")}) {
+		t.Errorf("Flush() = %v, want [10.1.0.0/24]", rest)
+	}
+}
@@ -0,0 +1,114 @@
+package aggregate
+
+// node is a single bit position in the trie. A marked node represents a
+// prefix that is part of the aggregated result; its subtree is pruned once
+// marked, since nothing below it can add information.
+type node struct {
+	children [2]*node
+	marked   bool
+}
+
+// rawPrefix is the address family-agnostic shape the trie works in: addr
+// holds the big-endian network address (4 bytes for IPv4, 16 for IPv6) and
+// bits is the prefix length.
+type rawPrefix struct {
+	addr []byte
+	bits int
+}
+
+// trie aggregates prefixes of a single address family, inserted in any
+// order; width is the address bit width (32 for IPv4, 128 for IPv6). See
+// the package doc for the complexity this buys over a naive merge.
+type trie struct {
+	root  *node
+	width int
+}
+
+func newTrie(width int) *trie {
+	return &trie{root: &node{}, width: width}
+}
+
+// insert adds addr/bits to the trie. Two rules keep it aggregated as it
+// grows:
+//  1. if an ancestor is already marked (a covering prefix was inserted),
+//     the insert is dropped;
+//  2. if marking this node leaves both children of some ancestor marked at
+//     the same depth, those children collapse into the ancestor, and the
+//     check repeats going up, so merges cascade as far as they can.
+//
+// Insertion order does not matter: a subnet inserted before its supernet is
+// absorbed when the supernet is marked, since marking a node prunes its
+// subtree.
+func (t *trie) insert(addr []byte, bits int) {
+	path := make([]*node, 1, bits+1)
+	n := t.root
+	path[0] = n
+	for i := 0; i < bits; i++ {
+		if n.marked {
+			return
+		}
+		bit := bitAt(addr, i)
+		if n.children[bit] == nil {
+			n.children[bit] = &node{}
+		}
+		n = n.children[bit]
+		path = append(path, n)
+	}
+	if n.marked {
+		return
+	}
+	n.children[0] = nil
+	n.children[1] = nil
+	n.marked = true
+
+	for i := len(path) - 2; i >= 0; i-- {
+		parent := path[i]
+		c0, c1 := parent.children[0], parent.children[1]
+		if c0 == nil || c1 == nil || !c0.marked || !c1.marked {
+			break
+		}
+		parent.children[0] = nil
+		parent.children[1] = nil
+		parent.marked = true
+	}
+}
+
+// flush collects the marked prefixes via a DFS that always visits the 0
+// child before the 1 child, so the result comes out in ascending address
+// order.
+func (t *trie) flush() []rawPrefix {
+	addr := make([]byte, t.width/8)
+	var out []rawPrefix
+	var walk func(n *node, depth int)
+	walk = func(n *node, depth int) {
+		if n.marked {
+			p := make([]byte, len(addr))
+			copy(p, addr)
+			out = append(out, rawPrefix{addr: p, bits: depth})
+			return
+		}
+		if n.children[0] != nil {
+			walk(n.children[0], depth+1)
+		}
+		if n.children[1] != nil {
+			setBit(addr, depth, 1)
+			walk(n.children[1], depth+1)
+			setBit(addr, depth, 0)
+		}
+	}
+	walk(t.root, 0)
+	return out
+}
+
+func bitAt(addr []byte, i int) int {
+	return int((addr[i/8] >> (7 - uint(i%8))) & 1)
+}
+
+func setBit(addr []byte, i, v int) {
+	mask := byte(1) << (7 - uint(i%8))
+	if v == 1 {
+		addr[i/8] |= mask
+	} else {
+		addr[i/8] &^= mask
+	}
+}
@@ -2,18 +2,25 @@ package main
 
 import (
 	"bufio"
+	"encoding/json"
 	"flag"
 	"fmt"
+	"math/big"
+	"net"
+	"net/netip"
 	"os"
-	"sort"
 	"strings"
 
+	"github.com/0xck/misc/pkg/aggregate"
 	"github.com/c-robinson/iplib"
 )
 
 type Conf struct {
-	str      string
-	filePath string
+	str             string
+	filePath        string
+	exclude         string
+	excludeFilePath string
+	format          string
 }
 
 var cfg Conf
@@ -91,129 +98,307 @@ func getNetsFromInput(str string, path string) ([]string, error) {
 	return list, err
 }
 
-func getNetsFromString(str []string) ([]iplib.Net, error) {
-	var list []iplib.Net
-	var err error = nil
+// parseNet turns a single input token into the networks it represents. It
+// accepts three shapes: a CIDR ("1.1.1.0/24"), a dash-separated range
+// ("1.1.1.0-1.1.1.244"), decomposed into its minimal covering CIDRs, or a
+// bare address ("1.1.1.5"), treated as a single host (/32 or /128).
+func parseNet(s string) ([]iplib.Net, error) {
+	if strings.Contains(s, "-") {
+		nets, err := rangeToNets(s)
+		if err != nil {
+			return nil, fmt.Errorf("Bad IP range value: <%s>", s)
+		}
+		return nets, nil
+	}
 
-	for _, s := range str {
+	if strings.Contains(s, "/") {
 		_, n, e := iplib.ParseCIDR(s)
 		if e != nil {
-			err = fmt.Errorf("Bad IP network value: <%s>", s)
-			return list, err
+			return nil, fmt.Errorf("Bad IP network value: <%s>", s)
 		}
-		list = append(list, n)
+		return []iplib.Net{n}, nil
 	}
-	// it is very important to keep network list sorted, then absorbing works properly
-	sort.Sort(iplib.ByNet(list))
-	return list, err
-}
 
-// absorbing small net by more large net
-// if possible supernet is not real super net for given net, then
-// adding the latter to absorbed and make it a new supernet for further nets checking
-// otherwise do nothing, just skip the net due to one is absorbed by supernet
-// 192.168.0.0/22, 192.168.0.0/24, 192.168.2.0/24 -> 192.168.0.0/22
-// Note. Absorbed must be sorted, otherwise it can not work properly
-func largeNetsAbsorbSmall(absorbed []iplib.Net, superNet iplib.Net, net iplib.Net) ([]iplib.Net, iplib.Net) {
-	if !superNet.ContainsNet(net) {
-		absorbed = append(absorbed, net)
-		superNet = net
-	}
-	return absorbed, superNet
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil, fmt.Errorf("Bad IP address value: <%s>", s)
+	}
+	masklen := 32
+	if iplib.EffectiveVersion(ip) == 6 {
+		masklen = 128
+	}
+	return []iplib.Net{iplib.NewNet(ip, masklen)}, nil
 }
 
-func lastIsNotGiven(sources []iplib.Net, nets ...iplib.Net) bool {
-	last := sources[len(sources)-1]
-	result := true
-	for _, i := range nets {
-		result = result && iplib.CompareNets(last, i) != 0
+// rangeToNets decomposes a dash-separated IP range into the minimal set of
+// CIDRs that cover it exactly: repeatedly emit the largest prefix whose
+// network address equals the current start and whose broadcast does not
+// exceed the end, then advance start past it.
+func rangeToNets(s string) ([]iplib.Net, error) {
+	parts := strings.SplitN(s, "-", 2)
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("not a range")
+	}
+
+	start := net.ParseIP(strings.TrimSpace(parts[0]))
+	end := net.ParseIP(strings.TrimSpace(parts[1]))
+	if start == nil || end == nil {
+		return nil, fmt.Errorf("not a range")
+	}
+
+	version := iplib.EffectiveVersion(start)
+	if iplib.EffectiveVersion(end) != version {
+		return nil, fmt.Errorf("range endpoints belong to different address families")
+	}
+
+	maxBits := 32
+	if version == 6 {
+		maxBits = 128
 	}
-	return result
-}
 
-// compares 2 nets if both have the same maximum closest supernet (e.i. mask - 1), then
-// aggregate both to that supernet (merge to large),
-// otherwise adding both
-// 192.168.0.0/24, 192.168.1.0/24 -> 192.168.0.0/23
-func smallMergedToLarge(aggregated []iplib.Net, net1 iplib.Net, net2 iplib.Net) ([]iplib.Net, iplib.Net) {
-	net1SuperNet, _ := net1.Supernet(0)
-	net2SuperNet, _ := net2.Supernet(0)
-	prefixNet1, _ := net1.Mask.Size()
-	prefixNet2, _ := net2.Mask.Size()
-
-	// both have the same maximum closest supernet
-	if prefixNet1 == prefixNet2 && iplib.CompareNets(net1SuperNet, net2SuperNet) == 0 {
-		// if net1 is already in aggregated it has to be deleted if supernet is found
-		if len(aggregated) != 0 && !lastIsNotGiven(aggregated, net1) {
-			aggregated = aggregated[:len(aggregated)-1]
+	cur := iplib.IPToBigint(start)
+	last := iplib.IPToBigint(end)
+	if cur.Cmp(last) > 0 {
+		return nil, fmt.Errorf("range start is greater than range end")
+	}
+
+	one := big.NewInt(1)
+	var nets []iplib.Net
+	for cur.Cmp(last) <= 0 {
+		hostBits := 0
+		for hostBits < maxBits {
+			blockSize := new(big.Int).Lsh(one, uint(hostBits+1))
+			if new(big.Int).Mod(cur, blockSize).Sign() != 0 {
+				break
+			}
+			blockEnd := new(big.Int).Add(cur, blockSize)
+			blockEnd.Sub(blockEnd, one)
+			if blockEnd.Cmp(last) > 0 {
+				break
+			}
+			hostBits++
 		}
-		aggregated = append(aggregated, net1SuperNet)
-		return aggregated, net2
+
+		nets = append(nets, iplib.NewNet(bigintToIP(cur, version), maxBits-hostBits))
+		cur.Add(cur, new(big.Int).Lsh(one, uint(hostBits)))
 	}
 
-	if len(aggregated) == 0 {
-		aggregated = append(aggregated, net1)
-		// if last aggregated is not net1 or its maximum closest supernet, then adding one
-	} else if lastIsNotGiven(aggregated, net1, net1SuperNet) {
-		aggregated = append(aggregated, net1)
+	return nets, nil
+}
+
+// bigintToIP converts a big.Int back into a net.IP of the given address
+// family; iplib only provides the reverse conversion for IPv6.
+func bigintToIP(z *big.Int, version int) net.IP {
+	if version == 6 {
+		return iplib.BigintToIP6(z)
 	}
-	aggregated = append(aggregated, net2)
+	return iplib.Uint32ToIP4(uint32(z.Uint64()))
+}
 
-	return aggregated, net2
+// getNetsFromString parses every entry in str as a CIDR, range or bare
+// address. The result is handed off unordered and unbucketed: aggregateNetworks
+// does its own family bucketing and the trie merge it uses doesn't care
+// about insertion order.
+func getNetsFromString(str []string) ([]iplib.Net, error) {
+	var list []iplib.Net
+
+	for _, s := range str {
+		parsed, err := parseNet(s)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, parsed...)
+	}
+	return list, nil
 }
 
+// aggregateNetworks converts nets to netip.Prefix and hands them to
+// aggregate.Aggregate, which buckets by address family internally (see its
+// package doc for the complexity this buys).
 func aggregateNetworks(nets []iplib.Net) []iplib.Net {
-	if len(nets) < 2 {
+	if len(nets) == 0 {
 		return nets
 	}
-	sourceNets := nets
-	netsNumber := len(nets)
-
-	// absorb small networks by more large
-	var absorbed []iplib.Net
-	superNet := sourceNets[0]
-	absorbed = append(absorbed, superNet)
-	for _, net := range sourceNets[1:] {
-		absorbed, superNet = largeNetsAbsorbSmall(absorbed, superNet, net)
-	}
-	// no more network for handling, one absorbed all
-	if len(absorbed) == 1 {
-		return absorbed
-	}
-	sourceNets = absorbed
-
-	// merge closest networks
-	// 192.168.0.0/24, 192.168.1.0/24 -> 192.168.0.0/23
-	// 192.168.2.0/24, 192.168.3.0/24 -> 192.168.2.0/23
-	// 192.168.0.0/23, 192.168.2.0/23 -> 192.168.0.0/22
-	for {
-		var mergeList []iplib.Net
-		net1 := sourceNets[0]
-		for _, net2 := range sourceNets[1:] {
-			mergeList, net1 = smallMergedToLarge(mergeList, net1, net2)
+
+	prefixes := make([]netip.Prefix, len(nets))
+	for i, n := range nets {
+		prefixes[i] = toPrefix(n)
+	}
+	return prefixesToNets(aggregate.Aggregate(prefixes))
+}
+
+// toPrefix converts an iplib.Net to the equivalent netip.Prefix.
+func toPrefix(n iplib.Net) netip.Prefix {
+	ip := n.IPNet.IP
+	if n.Version() == 6 {
+		ip = ip.To16()
+	} else {
+		ip = ip.To4()
+	}
+	addr, _ := netip.AddrFromSlice(ip)
+	ones, _ := n.Mask.Size()
+	return netip.PrefixFrom(addr, ones)
+}
+
+// prefixesToNets converts a slice of netip.Prefix back to iplib.Net, the
+// type the rest of this file works in.
+func prefixesToNets(prefixes []netip.Prefix) []iplib.Net {
+	nets := make([]iplib.Net, len(prefixes))
+	for i, p := range prefixes {
+		addr := p.Addr()
+		var ip net.IP
+		if addr.Is4() {
+			b := addr.As4()
+			ip = net.IP(b[:])
+		} else {
+			b := addr.As16()
+			ip = net.IP(b[:])
 		}
-		sourceNets = mergeList
-		// nothing changed e.i. no closest networks or all megred to one
-		if len(sourceNets) == netsNumber || len(sourceNets) == 1 {
-			break
+		nets[i] = iplib.NewNet(ip, p.Bits())
+	}
+	return nets
+}
+
+// subtractNetworks computes the CIDR set difference nets \ excludes, i.e.
+// the minimal cover of everything in nets that isn't also in excludes.
+// nets and excludes are each expected to already be aggregated (disjoint,
+// minimal) per address family.
+func subtractNetworks(nets []iplib.Net, excludes []iplib.Net) []iplib.Net {
+	result := nets
+	for _, e := range excludes {
+		var remainder []iplib.Net
+		for _, n := range result {
+			switch {
+			case n.Version() != e.Version():
+				remainder = append(remainder, n)
+			case n.ContainsNet(e):
+				remainder = append(remainder, subtractNet(n, e)...)
+			case e.ContainsNet(n):
+				// e fully covers n, so all of n is excluded; drop it.
+			default:
+				remainder = append(remainder, n)
+			}
 		}
-		netsNumber = len(sourceNets)
+		result = remainder
 	}
+	return result
+}
+
+// subtractNet removes excluded from net, assuming net.ContainsNet(excluded).
+// It recursively splits net into its two halves, keeps the half that doesn't
+// contain excluded untouched, and recurses into the half that does until the
+// masks match, at which point excluded itself is dropped entirely.
+func subtractNet(net iplib.Net, excluded iplib.Net) []iplib.Net {
+	netMask, _ := net.Mask.Size()
+	excludedMask, _ := excluded.Mask.Size()
+	if netMask == excludedMask {
+		return nil
+	}
+
+	// iplib's Subnet(0) checks ones > masklen before substituting the
+	// "carve in half" default, so it always errors; pass ones+1 explicitly.
+	halves, _ := net.Subnet(netMask + 1)
+	var remainder []iplib.Net
+	for _, half := range halves {
+		if half.ContainsNet(excluded) {
+			remainder = append(remainder, subtractNet(half, excluded)...)
+		} else {
+			remainder = append(remainder, half)
+		}
+	}
+	return remainder
+}
 
-	return sourceNets
+// jsonNet is the per-network shape for -format json.
+type jsonNet struct {
+	CIDR  string   `json:"cidr"`
+	First string   `json:"first"`
+	Last  string   `json:"last"`
+	Count *big.Int `json:"count"`
 }
 
-func printResult(result []iplib.Net) {
-	for _, i := range result {
-		ip := i.IPNet.IP
-		mask, _ := i.Mask.Size()
-		fmt.Printf("%v/%v\n", ip, mask)
+// netCount returns the total number of addresses in n as 2^(size-prefix),
+// using big.Int so it works for IPv6 prefixes as well as IPv4.
+func netCount(n iplib.Net) *big.Int {
+	size := 32
+	if n.Version() == 6 {
+		size = 128
 	}
+	prefix, _ := n.Mask.Size()
+	return new(big.Int).Exp(big.NewInt(2), big.NewInt(int64(size-prefix)), nil)
+}
+
+// printResult dispatches to the printer for the requested format. An
+// unrecognised format is an error so typos don't silently fall back to cidr.
+func printResult(result []iplib.Net, format string) error {
+	switch format {
+	case "", "cidr":
+		printCIDR(result)
+	case "range":
+		printRange(result)
+	case "netmask":
+		printNetmask(result)
+	case "json":
+		return printJSON(result)
+	case "count":
+		printCount(result)
+	default:
+		return fmt.Errorf("Unknown format: <%s>", format)
+	}
+	return nil
+}
+
+func printCIDR(result []iplib.Net) {
+	for _, n := range result {
+		mask, _ := n.Mask.Size()
+		fmt.Printf("%v/%v\n", n.IPNet.IP, mask)
+	}
+}
+
+func printRange(result []iplib.Net) {
+	for _, n := range result {
+		fmt.Printf("%v-%v\n", n.NetworkAddress(), n.BroadcastAddress())
+	}
+}
+
+func printNetmask(result []iplib.Net) {
+	for _, n := range result {
+		// net.IPMask.String() renders as bare hex; net.IP.String() gives the
+		// expected dotted-decimal (v4) or colon-hex (v6) form instead.
+		fmt.Printf("%v %v\n", n.IPNet.IP, net.IP(n.Mask))
+	}
+}
+
+func printJSON(result []iplib.Net) error {
+	entries := make([]jsonNet, len(result))
+	for i, n := range result {
+		mask, _ := n.Mask.Size()
+		entries[i] = jsonNet{
+			CIDR:  fmt.Sprintf("%v/%v", n.IPNet.IP, mask),
+			First: n.NetworkAddress().String(),
+			Last:  n.BroadcastAddress().String(),
+			Count: netCount(n),
+		}
+	}
+	out, err := json.Marshal(entries)
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(out))
+	return nil
+}
+
+func printCount(result []iplib.Net) {
+	total := big.NewInt(0)
+	for _, n := range result {
+		total.Add(total, netCount(n))
+	}
+	fmt.Println(total.String())
 }
 
 func init() {
-	description := `IPv4 networks aggregation.
-App aggregates IPv4 networks from given string or file with following mechanic:
+	description := `IPv4/IPv6 networks aggregation.
+App aggregates IPv4 and IPv6 networks from given string or file with following mechanic:
 1. largest prefix absorbs all its subnet prefixes,
 	e.g. 10.0.0.0/16 absorbs 10.0.0.0/22, 10.10.0.0/24 and so on;
 2. prefixes of the same length merged to their supernet, which prefix is one less,
@@ -221,6 +406,17 @@ App aggregates IPv4 networks from given string or file with following mechanic:
 	but 10.0.0.0/24, 10.0.2.0/24 will not be merged to 10.0.0.0/22,
 	because their closest supernets (/23) are different
 	and all merging operations are handled only if supernet prefix is one less.
+Input entries may be CIDRs (10.0.0.0/24), dash-separated ranges (10.0.0.0-10.0.0.244,
+decomposed into their minimal covering CIDRs) or bare addresses (10.0.0.5, treated as /32 or /128).
+If -exclude or -excludefilepath is given, its aggregated networks are subtracted from the
+result, e.g. to remove RFC1918 or bogon ranges from an aggregated allow list.
+Result is printed as CIDRs by default; -format selects cidr, range (start-end), netmask
+(ip mask), json (array of cidr/first/last/count) or count (total address count).
+If -filepath - is given, networks are instead streamed line by line from stdin and
+aggregated results are printed as soon as nothing later in the stream can still merge
+with them, instead of buffering the whole input. This only aggregates correctly if the
+input is already sorted in ascending network address order, and is incompatible with
+-exclude, -excludefilepath, -format json and -format count (which need the whole result at once).
 	`
 	flag.Usage = func() {
 		fmt.Fprintf(flag.CommandLine.Output(), "%s", description)
@@ -229,13 +425,67 @@ App aggregates IPv4 networks from given string or file with following mechanic:
 	//getting args
 	flag.StringVar(&cfg.str, "string", "", "Quoted string of networks separated by space")
 	flag.StringVar(&cfg.filePath, "filepath", "", "Path to file which contains networks separated by new line")
+	flag.StringVar(&cfg.exclude, "exclude", "", "Quoted string of networks to subtract from the result, separated by space")
+	flag.StringVar(&cfg.excludeFilePath, "excludefilepath", "", "Path to file which contains networks to subtract from the result, separated by new line")
+	flag.StringVar(&cfg.format, "format", "cidr", "Output format: cidr, range, netmask, json or count")
 	flag.Parse()
 }
 
+// runStream aggregates networks read line by line from stdin, printing each
+// batch aggregate.StreamAggregator finalizes as soon as it arrives rather
+// than buffering the whole input. It relies on the input already being
+// sorted in ascending network address order; see StreamAggregator's doc
+// comment for what that guarantees.
+func runStream() error {
+	if strings.TrimSpace(cfg.str) != "" {
+		return fmt.Errorf("Both input options can not be used at the same time")
+	}
+	if strings.TrimSpace(cfg.exclude) != "" || strings.TrimSpace(cfg.excludeFilePath) != "" {
+		return fmt.Errorf("-exclude is not supported together with streaming input (-filepath -)")
+	}
+	if cfg.format == "json" || cfg.format == "count" {
+		return fmt.Errorf("-format %s is not supported together with streaming input (-filepath -)", cfg.format)
+	}
+
+	sa := aggregate.NewStreamAggregator()
+	scanner := bufio.NewScanner(os.Stdin)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+
+		parsed, err := parseNet(line)
+		if err != nil {
+			return err
+		}
+		for _, n := range parsed {
+			if done := sa.Add(toPrefix(n)); len(done) > 0 {
+				if err := printResult(prefixesToNets(done), cfg.format); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	return printResult(prefixesToNets(sa.Flush()), cfg.format)
+}
+
 func main() {
 	exitCode := 0
 	defer func() { os.Exit(exitCode) }()
 
+	if cfg.filePath == "-" {
+		if err := runStream(); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			exitCode = 1
+		}
+		return
+	}
+
 	stringNets, err := getNetsFromInput(cfg.str, cfg.filePath)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
@@ -252,5 +502,27 @@ func main() {
 
 	result := aggregateNetworks(nets)
 
-	printResult(result)
+	if strings.TrimSpace(cfg.exclude) != "" || strings.TrimSpace(cfg.excludeFilePath) != "" {
+		excludeStrings, err := getNetsFromInput(cfg.exclude, cfg.excludeFilePath)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			exitCode = 1
+			return
+		}
+
+		excludeNets, err := getNetsFromString(excludeStrings)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			exitCode = 1
+			return
+		}
+
+		result = subtractNetworks(result, aggregateNetworks(excludeNets))
+	}
+
+	if err := printResult(result, cfg.format); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		exitCode = 1
+		return
+	}
 }